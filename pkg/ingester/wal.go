@@ -2,12 +2,18 @@ package ingester
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/log/level"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/tsdb/wal"
@@ -17,13 +23,69 @@ import (
 	"github.com/cortexproject/cortex/pkg/util"
 )
 
+// walCompressionType selects the per-record compression format used when
+// writing to the WAL. It implements flag.Value so it can be validated at
+// flag-parsing time.
+type walCompressionType string
+
+// Supported values for the ingester.wal-compression flag.
+const (
+	compressionNone   walCompressionType = "none"
+	compressionSnappy walCompressionType = "snappy"
+)
+
+func (c *walCompressionType) String() string {
+	return string(*c)
+}
+
+func (c *walCompressionType) Set(s string) error {
+	switch walCompressionType(s) {
+	case compressionNone, compressionSnappy:
+		*c = walCompressionType(s)
+		return nil
+	default:
+		return fmt.Errorf("invalid WAL compression type %q, must be one of none|snappy", s)
+	}
+}
+
+// Format prefix prepended to every WAL record so recoverRecordsFrom can tell
+// compressed records from uncompressed ones without a separate segment
+// header. Any record written before this change has no prefix byte; those
+// segments are only ever read by the legacy recovery path.
+const (
+	walFormatUncompressed byte = 0
+	walFormatSnappy       byte = 1
+)
+
+// commaSeparatedList is a flag.Value that parses a comma-separated list of
+// strings, skipping empty elements.
+type commaSeparatedList []string
+
+func (l *commaSeparatedList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *commaSeparatedList) Set(s string) error {
+	*l = nil
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			*l = append(*l, part)
+		}
+	}
+	return nil
+}
+
 // WALConfig is config for the Write Ahead Log.
 type WALConfig struct {
-	enabled            bool
-	recover            bool
-	dir                string
-	checkpointDuration time.Duration
-	metricsRegisterer  prometheus.Registerer
+	enabled                        bool
+	recover                        bool
+	dir                            string
+	checkpointDuration             time.Duration
+	checkpointDirtySeriesThreshold int
+	walCompression                 walCompressionType
+	recoverTenants                 commaSeparatedList
+	recoverConcurrency             int
+	metricsRegisterer              prometheus.Registerer
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -32,12 +94,27 @@ func (cfg *WALConfig) RegisterFlags(f *flag.FlagSet) {
 	f.BoolVar(&cfg.recover, "ingester.wal-recover", false, "Recover from the WAL on startup.")
 	f.StringVar(&cfg.dir, "ingester.wal-dir", "", "Directory to store the WAL.")
 	f.DurationVar(&cfg.checkpointDuration, "ingester.checkpoint-duration", 1*time.Hour, "Duration over which to checkpoint.")
+	f.IntVar(&cfg.checkpointDirtySeriesThreshold, "ingester.checkpoint-dirty-series-threshold", 5000, "Trigger a checkpoint early if this many series have been modified since the last one; 0 disables early checkpointing.")
+	cfg.walCompression = compressionNone
+	f.Var(&cfg.walCompression, "ingester.wal-compression", "Compress WAL records with the given algorithm, to cut disk I/O. Supported values: none, snappy.")
+	f.Var(&cfg.recoverTenants, "ingester.wal-recover-tenants", "Comma-separated list of tenant IDs to recover from the WAL on startup; if empty, all tenants are recovered. Not applied when migrating the legacy flat WAL layout, which recovers every tenant.")
+	f.IntVar(&cfg.recoverConcurrency, "ingester.wal-recover-concurrency", 8, "Number of tenants to recover from the WAL in parallel.")
 }
 
+// dirtyCheckInterval is how often run() polls the dirty series counter to
+// see if it has crossed checkpointDirtySeriesThreshold. It's independent
+// of checkpointDuration, which fires regardless of how dirty we are.
+const dirtyCheckInterval = 10 * time.Second
+
 // WAL interface allows us to have a no-op WAL when the WAL is disabled.
 type WAL interface {
 	Log(record *Record) error
 	Stop()
+
+	// Tail registers a subscriber that streams a tenant's samples records
+	// as they're written to the WAL, starting from startSegment. See
+	// WALTailer.
+	Tail(userID, name string, startSegment int, handler func(*Record) error) (walCursor, error)
 }
 
 type noop struct{}
@@ -50,16 +127,50 @@ func (noop) Log(*Record) error {
 // Stop any background WAL processes.
 func (noop) Stop() {}
 
+// Tail is a no-op: there's nothing to subscribe to when the WAL is disabled.
+func (noop) Tail(userID, name string, startSegment int, handler func(*Record) error) (walCursor, error) {
+	return walCursor{}, nil
+}
+
+// wrapper lays the WAL out per tenant, as wal/<userID>/samples and
+// wal/<userID>/checkpoints, so that recovery can skip one tenant's corrupt
+// segment without blocking the rest. Checkpoints still cover all tenants
+// in one pass, triggered by a dirty series count shared across tenants.
+// samples, checkpoints and tailers are created lazily, the first time a
+// given tenant is seen.
 type wrapper struct {
 	cfg      WALConfig
 	ingester *Ingester
 	quit     chan struct{}
 	wait     sync.WaitGroup
 
-	lastCheckpointSegment int
-	lastSamplesSegment    int
-	samples               *wal.WAL
-	checkpoints           *wal.WAL
+	samplesMtx     sync.Mutex
+	samples        map[string]*wal.WAL
+	lastSamplesSeg map[string]int
+
+	checkpointsMtx    sync.Mutex
+	checkpoints       map[string]*wal.WAL
+	lastCheckpointSeg map[string]int
+
+	tailersMtx sync.Mutex
+	tailers    map[string]*WALTailer
+
+	recordBytes *prometheus.CounterVec
+
+	// dirtySeries tracks the distinct fingerprints that have been written
+	// to since the last checkpoint, so dirtySeriesCount reflects series
+	// churn rather than sample volume. maybeCheckpoint resets it after each
+	// successful checkpoint and truncation.
+	dirtySeriesMtx   sync.Mutex
+	dirtySeries      map[int64]struct{}
+	dirtySeriesCount int64 // len(dirtySeries), kept separately for lock-free reads in run()
+
+	// checkpointInProgress is set, atomically, while maybeCheckpoint is
+	// running a checkpoint, so that another trigger is skipped meanwhile.
+	checkpointInProgress int32
+
+	dirtySeriesGauge   prometheus.Gauge
+	checkpointDuration prometheus.Gauge
 }
 
 func newWAL(cfg WALConfig, ingester *Ingester) (WAL, error) {
@@ -67,30 +178,39 @@ func newWAL(cfg WALConfig, ingester *Ingester) (WAL, error) {
 		return &noop{}, nil
 	}
 
-	var samplesRegistry prometheus.Registerer
+	recordBytes := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cortex_ingester_wal_records_bytes_total",
+		Help: "Total number of WAL record bytes written, by compression format.",
+	}, []string{"compression"})
 	if cfg.metricsRegisterer != nil {
-		samplesRegistry = prometheus.WrapRegistererWith(prometheus.Labels{"kind": "samples"}, cfg.metricsRegisterer)
-	}
-	samples, err := wal.New(util.Logger, samplesRegistry, path.Join(cfg.dir, "samples"))
-	if err != nil {
-		return nil, err
+		cfg.metricsRegisterer.MustRegister(recordBytes)
 	}
 
-	var checkpointsRegistry prometheus.Registerer
+	dirtySeriesGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cortex_ingester_checkpoint_dirty_series",
+		Help: "Number of series modified since the last checkpoint.",
+	})
+	checkpointDurationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cortex_ingester_checkpoint_last_duration_seconds",
+		Help: "Duration in seconds taken to checkpoint the last time.",
+	})
 	if cfg.metricsRegisterer != nil {
-		checkpointsRegistry = prometheus.WrapRegistererWith(prometheus.Labels{"kind": "checkpoints"}, cfg.metricsRegisterer)
-	}
-	checkpoints, err := wal.New(util.Logger, checkpointsRegistry, path.Join(cfg.dir, "checkpoints"))
-	if err != nil {
-		return nil, err
+		cfg.metricsRegisterer.MustRegister(dirtySeriesGauge, checkpointDurationGauge)
 	}
 
 	w := &wrapper{
-		cfg:         cfg,
-		ingester:    ingester,
-		quit:        make(chan struct{}),
-		samples:     samples,
-		checkpoints: checkpoints,
+		cfg:                cfg,
+		ingester:           ingester,
+		quit:               make(chan struct{}),
+		samples:            map[string]*wal.WAL{},
+		lastSamplesSeg:     map[string]int{},
+		checkpoints:        map[string]*wal.WAL{},
+		lastCheckpointSeg:  map[string]int{},
+		tailers:            map[string]*WALTailer{},
+		recordBytes:        recordBytes,
+		dirtySeries:        map[int64]struct{}{},
+		dirtySeriesGauge:   dirtySeriesGauge,
+		checkpointDuration: checkpointDurationGauge,
 	}
 
 	if cfg.recover {
@@ -106,8 +226,88 @@ func (w *wrapper) Stop() {
 	close(w.quit)
 	w.wait.Wait()
 
-	w.samples.Close()
-	w.checkpoints.Close()
+	w.tailersMtx.Lock()
+	for _, t := range w.tailers {
+		t.Stop()
+	}
+	w.tailersMtx.Unlock()
+
+	w.samplesMtx.Lock()
+	for _, s := range w.samples {
+		s.Close()
+	}
+	w.samplesMtx.Unlock()
+
+	w.checkpointsMtx.Lock()
+	for _, c := range w.checkpoints {
+		c.Close()
+	}
+	w.checkpointsMtx.Unlock()
+}
+
+// Tail registers name as a subscriber of userID's samples WAL; see
+// WALTailer.
+func (w *wrapper) Tail(userID, name string, startSegment int, handler func(*Record) error) (walCursor, error) {
+	tailer, err := w.getTailer(userID)
+	if err != nil {
+		return walCursor{}, err
+	}
+	return tailer.Subscribe(name, startSegment, handler)
+}
+
+func (w *wrapper) getSamplesWAL(userID string) (*wal.WAL, error) {
+	w.samplesMtx.Lock()
+	defer w.samplesMtx.Unlock()
+
+	if samples, ok := w.samples[userID]; ok {
+		return samples, nil
+	}
+
+	var registry prometheus.Registerer
+	if w.cfg.metricsRegisterer != nil {
+		registry = prometheus.WrapRegistererWith(prometheus.Labels{"kind": "samples", "user": userID}, w.cfg.metricsRegisterer)
+	}
+	samples, err := wal.New(util.Logger, registry, path.Join(w.cfg.dir, userID, "samples"))
+	if err != nil {
+		return nil, err
+	}
+
+	w.samples[userID] = samples
+	return samples, nil
+}
+
+func (w *wrapper) getCheckpointsWAL(userID string) (*wal.WAL, error) {
+	w.checkpointsMtx.Lock()
+	defer w.checkpointsMtx.Unlock()
+
+	if checkpoints, ok := w.checkpoints[userID]; ok {
+		return checkpoints, nil
+	}
+
+	var registry prometheus.Registerer
+	if w.cfg.metricsRegisterer != nil {
+		registry = prometheus.WrapRegistererWith(prometheus.Labels{"kind": "checkpoints", "user": userID}, w.cfg.metricsRegisterer)
+	}
+	checkpoints, err := wal.New(util.Logger, registry, path.Join(w.cfg.dir, userID, "checkpoints"))
+	if err != nil {
+		return nil, err
+	}
+
+	w.checkpoints[userID] = checkpoints
+	return checkpoints, nil
+}
+
+func (w *wrapper) getTailer(userID string) (*WALTailer, error) {
+	w.tailersMtx.Lock()
+	defer w.tailersMtx.Unlock()
+
+	if tailer, ok := w.tailers[userID]; ok {
+		return tailer, nil
+	}
+
+	tailer := newWALTailer(path.Join(w.cfg.dir, userID, "samples"))
+	w.tailers[userID] = tailer
+	return tailer, nil
 }
 
 func (w *wrapper) Log(record *Record) error {
@@ -115,47 +315,135 @@ func (w *wrapper) Log(record *Record) error {
 	if err != nil {
 		return err
 	}
-	return w.samples.Log(buf)
+
+	samples, err := w.getSamplesWAL(record.UserId)
+	if err != nil {
+		return err
+	}
+	if err := samples.Log(w.encode(buf)); err != nil {
+		return err
+	}
+
+	w.markDirty(record.Samples)
+	return nil
+}
+
+// markDirty records the fingerprints in samples as modified since the last
+// checkpoint, so dirtySeriesCount reflects the number of distinct series
+// touched rather than the number of sample appends.
+func (w *wrapper) markDirty(samples []Sample) {
+	if len(samples) == 0 {
+		return
+	}
+
+	w.dirtySeriesMtx.Lock()
+	for _, sample := range samples {
+		w.dirtySeries[sample.Fingerprint] = struct{}{}
+	}
+	dirty := int64(len(w.dirtySeries))
+	w.dirtySeriesMtx.Unlock()
+
+	atomic.StoreInt64(&w.dirtySeriesCount, dirty)
+	w.dirtySeriesGauge.Set(float64(dirty))
+}
+
+// encode prepends the one-byte format prefix described above, compressing
+// buf first if the WAL is configured to do so.
+func (w *wrapper) encode(buf []byte) []byte {
+	if w.cfg.walCompression != compressionSnappy {
+		w.recordBytes.WithLabelValues(string(compressionNone)).Add(float64(len(buf) + 1))
+		return append([]byte{walFormatUncompressed}, buf...)
+	}
+
+	compressed := snappy.Encode(nil, buf)
+	w.recordBytes.WithLabelValues(string(compressionSnappy)).Add(float64(len(compressed) + 1))
+	return append([]byte{walFormatSnappy}, compressed...)
 }
 
+// decode strips the format prefix added by encode, decompressing the
+// payload if necessary. An unrecognized first byte is treated as a legacy
+// record with no prefix at all, rather than an error.
+func decode(rec []byte) ([]byte, error) {
+	if len(rec) == 0 {
+		return rec, nil
+	}
+
+	switch rec[0] {
+	case walFormatUncompressed:
+		return rec[1:], nil
+	case walFormatSnappy:
+		return snappy.Decode(nil, rec[1:])
+	default:
+		return rec, nil
+	}
+}
+
+// run is the WAL maintenance loop. It checkpoints either when
+// checkpointDuration elapses, or early when dirtySeriesCount crosses
+// checkpointDirtySeriesThreshold, whichever comes first - this keeps
+// crash-recovery WALs small after a burst of series writes. Either trigger
+// checkpoints every series of every tenant, idle or not.
 func (w *wrapper) run() {
 	defer w.wait.Done()
 
-	for !w.isStopped() {
-		if err := w.checkpoint(); err != nil {
-			level.Error(util.Logger).Log("msg", "Error checkpointing series", "err", err)
-			continue
-		}
+	ticker := time.NewTicker(w.cfg.checkpointDuration)
+	defer ticker.Stop()
 
-		if err := w.truncateSamples(); err != nil {
-			level.Error(util.Logger).Log("msg", "Error truncating wal", "err", err)
-			continue
+	dirtyTicker := time.NewTicker(dirtyCheckInterval)
+	defer dirtyTicker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.maybeCheckpoint("timer")
+
+		case <-dirtyTicker.C:
+			threshold := w.cfg.checkpointDirtySeriesThreshold
+			if threshold > 0 && atomic.LoadInt64(&w.dirtySeriesCount) >= int64(threshold) {
+				w.maybeCheckpoint("dirty_series")
+			}
+
+		case <-w.quit:
+			return
 		}
 	}
 }
 
-func (w *wrapper) isStopped() bool {
-	select {
-	case <-w.quit:
-		return true
-	default:
-		return false
+// maybeCheckpoint runs a checkpoint unless one is already in progress, in
+// which case it skips this trigger entirely rather than queueing up more
+// work behind a checkpoint that's already falling behind.
+func (w *wrapper) maybeCheckpoint(reason string) {
+	if !atomic.CompareAndSwapInt32(&w.checkpointInProgress, 0, 1) {
+		level.Debug(util.Logger).Log("msg", "skipping checkpoint, previous one still in progress", "reason", reason)
+		return
 	}
-}
+	defer atomic.StoreInt32(&w.checkpointInProgress, 0)
 
-func (w *wrapper) checkpoint() error {
-	// Count number of series - we'll use this to rate limit checkpoints.
-	numSeries := 0
-	for _, state := range w.ingester.userStates.cp() {
-		numSeries += state.fpToSeries.length()
+	start := time.Now()
+	if err := w.checkpoint(); err != nil {
+		level.Error(util.Logger).Log("msg", "Error checkpointing series", "err", err)
+		return
 	}
-	if numSeries == 0 {
-		return nil
+
+	if err := w.truncateSamples(); err != nil {
+		level.Error(util.Logger).Log("msg", "Error truncating wal", "err", err)
+		return
 	}
-	perSeriesDuration := w.cfg.checkpointDuration / time.Duration(numSeries)
-	ticker := time.NewTicker(perSeriesDuration)
-	defer ticker.Stop()
 
+	w.dirtySeriesMtx.Lock()
+	w.dirtySeries = map[int64]struct{}{}
+	w.dirtySeriesMtx.Unlock()
+	atomic.StoreInt64(&w.dirtySeriesCount, 0)
+	w.dirtySeriesGauge.Set(0)
+	w.checkpointDuration.Set(time.Since(start).Seconds())
+	level.Debug(util.Logger).Log("msg", "checkpoint complete", "reason", reason, "duration", time.Since(start))
+}
+
+// checkpoint writes out every series for every tenant, one tenant after
+// another, truncating each tenant's own checkpoints WAL once its series are
+// written. It returns on the first error, leaving later tenants
+// unwritten.
+func (w *wrapper) checkpoint() error {
 	for userID, state := range w.ingester.userStates.cp() {
 		for pair := range state.fpToSeries.iter() {
 			state.fpLocker.Lock(pair.fp)
@@ -164,23 +452,12 @@ func (w *wrapper) checkpoint() error {
 			if err != nil {
 				return err
 			}
-
-			select {
-			case <-ticker.C:
-			case <-w.quit: // When we're trying to shutdown, finish the checkpoint as fast as possible.
-			}
 		}
-	}
 
-	// Remove the previous checkpoint.
-	_, last, err := w.checkpoints.Segments()
-	if err != nil {
-		return err
-	}
-	if err := w.checkpoints.Truncate(w.lastCheckpointSegment); err != nil {
-		return err
+		if err := w.truncateCheckpoint(userID); err != nil {
+			return err
+		}
 	}
-	w.lastCheckpointSegment = last
 
 	return nil
 }
@@ -201,89 +478,242 @@ func (w *wrapper) checkpointSeries(userID string, fp model.Fingerprint, series *
 		return err
 	}
 
-	return w.checkpoints.Log(buf)
+	checkpoints, err := w.getCheckpointsWAL(userID)
+	if err != nil {
+		return err
+	}
+
+	return checkpoints.Log(w.encode(buf))
 }
 
-// truncateSamples removed the wal from before the checkpoint.
-func (w *wrapper) truncateSamples() error {
-	_, last, err := w.samples.Segments()
+// truncateCheckpoint removes userID's previous checkpoint, now that a new
+// one has just been written.
+func (w *wrapper) truncateCheckpoint(userID string) error {
+	checkpoints, err := w.getCheckpointsWAL(userID)
 	if err != nil {
 		return err
 	}
 
-	if err := w.samples.Truncate(w.lastSamplesSegment); err != nil {
+	_, last, err := checkpoints.Segments()
+	if err != nil {
 		return err
 	}
 
-	w.lastSamplesSegment = last
+	w.checkpointsMtx.Lock()
+	lastSeg := w.lastCheckpointSeg[userID]
+	w.checkpointsMtx.Unlock()
+
+	if err := checkpoints.Truncate(lastSeg); err != nil {
+		return err
+	}
+
+	w.checkpointsMtx.Lock()
+	w.lastCheckpointSeg[userID] = last
+	w.checkpointsMtx.Unlock()
+
 	return nil
 }
 
-func (w *wrapper) recover(ctx context.Context) error {
-	// Use a local userStates, so we don't need to worry about locking.
-	userStates := newUserStates(w.ingester.limits, w.ingester.cfg)
-
-	if err := w.recoverRecords("checkpoints", &Series{}, func(msg proto.Message) error {
-		walSeries := msg.(*Series)
+// truncateSamples removes the samples WAL from before the last checkpoint,
+// for every tenant seen so far. It won't remove a segment that a
+// registered WALTailer subscriber hasn't read past yet, so a slow
+// subscriber delays truncation rather than losing records.
+func (w *wrapper) truncateSamples() error {
+	w.samplesMtx.Lock()
+	userIDs := make([]string, 0, len(w.samples))
+	for userID := range w.samples {
+		userIDs = append(userIDs, userID)
+	}
+	w.samplesMtx.Unlock()
 
-		descs, err := fromWireChunks(walSeries.Chunks)
-		if err != nil {
+	for _, userID := range userIDs {
+		if err := w.truncateSamplesForUser(userID); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		userCtx := user.InjectOrgID(ctx, walSeries.UserId)
-		state, err := userStates.getOrCreate(userCtx)
-		if err != nil {
-			return err
-		}
+func (w *wrapper) truncateSamplesForUser(userID string) error {
+	samples, err := w.getSamplesWAL(userID)
+	if err != nil {
+		return err
+	}
 
-		series, err := state.createSeriesWithFingerprint(model.Fingerprint(walSeries.Fingerprint), walSeries.Labels, &Record{})
-		if err != nil {
-			return err
-		}
+	_, last, err := samples.Segments()
+	if err != nil {
+		return err
+	}
 
-		return series.setChunks(descs)
-	}); err != nil {
+	tailer, err := w.getTailer(userID)
+	if err != nil {
 		return err
 	}
+	if min, ok := tailer.minSegment(); ok && min < last {
+		last = min
+	}
 
-	if err := w.recoverRecords("samples", &Record{}, func(msg proto.Message) error {
-		record := msg.(*Record)
-		userCtx := user.InjectOrgID(ctx, record.UserId)
+	w.samplesMtx.Lock()
+	lastSeg := w.lastSamplesSeg[userID]
+	w.samplesMtx.Unlock()
 
-		state, err := userStates.getOrCreate(userCtx)
-		if err != nil {
-			return err
-		}
+	if err := samples.Truncate(lastSeg); err != nil {
+		return err
+	}
 
-		for _, labels := range record.Labels {
-			_, ok := state.fpToSeries.get(model.Fingerprint(labels.Fingerprint))
-			if ok {
-				continue
-			}
+	w.samplesMtx.Lock()
+	w.lastSamplesSeg[userID] = last
+	w.samplesMtx.Unlock()
 
-			_, err = state.createSeriesWithFingerprint(model.Fingerprint(labels.Fingerprint), labels.Labels, &Record{})
-			if err != nil {
-				return err
+	return nil
+}
+
+// recover rebuilds userStates from disk on startup, migrating the old flat
+// WAL layout (wal/samples, wal/checkpoints) if it's still present.
+func (w *wrapper) recover(ctx context.Context) error {
+	if w.legacyLayoutExists() {
+		level.Info(util.Logger).Log("msg", "found pre-partitioning WAL layout, replaying it once before switching to per-tenant directories")
+		return w.migrateLegacy(ctx)
+	}
+	return w.recoverTenants(ctx)
+}
+
+// migrateLegacy replays the old flat WAL layout, checkpoints it under the
+// new per-tenant layout, then removes the legacy directories so this
+// restart is the only one that ever replays them.
+func (w *wrapper) migrateLegacy(ctx context.Context) error {
+	if err := w.recoverLegacy(ctx); err != nil {
+		return err
+	}
+
+	if err := w.checkpoint(); err != nil {
+		return err
+	}
+
+	return w.removeLegacyLayout()
+}
+
+// removeLegacyLayout deletes the pre-partitioning flat WAL directories, so
+// legacyLayoutExists reports false from here on.
+func (w *wrapper) removeLegacyLayout() error {
+	if err := os.RemoveAll(path.Join(w.cfg.dir, "samples")); err != nil {
+		return err
+	}
+	return os.RemoveAll(path.Join(w.cfg.dir, "checkpoints"))
+}
+
+func (w *wrapper) legacyLayoutExists() bool {
+	_, err := os.Stat(path.Join(w.cfg.dir, "samples"))
+	return err == nil
+}
+
+// recoverTenants lists the tenant subdirectories under the WAL dir and
+// recovers each independently, with concurrency bounded by
+// cfg.recoverConcurrency. If cfg.recoverTenants is non-empty, only those
+// tenants are restored; this is the escape hatch for getting an ingester
+// back up when a specific tenant's WAL is corrupt.
+func (w *wrapper) recoverTenants(ctx context.Context) error {
+	tenants, err := w.listTenants()
+	if err != nil {
+		return err
+	}
+
+	if len(w.cfg.recoverTenants) > 0 {
+		wanted := map[string]bool{}
+		for _, t := range w.cfg.recoverTenants {
+			wanted[t] = true
+		}
+		filtered := tenants[:0]
+		for _, t := range tenants {
+			if wanted[t] {
+				filtered = append(filtered, t)
 			}
 		}
+		tenants = filtered
+	}
 
-		for _, sample := range record.Samples {
-			series, ok := state.fpToSeries.get(model.Fingerprint(sample.Fingerprint))
-			if !ok {
-				return nil
-			}
+	concurrency := w.cfg.recoverConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
 
-			err := series.add(model.SamplePair{
-				Timestamp: model.Time(sample.Timestamp),
-				Value:     model.SampleValue(sample.Value),
-			})
-			if err != nil {
-				level.Info(util.Logger).Log("msg", "error appending sample", "err", err)
+	userStates := newUserStates(w.ingester.limits, w.ingester.cfg)
+
+	sema := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, userID := range tenants {
+		userID := userID
+
+		wg.Add(1)
+		sema <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sema }()
+
+			if err := w.recoverTenant(ctx, userID, userStates); err != nil {
+				level.Error(util.Logger).Log("msg", "error recovering tenant WAL, skipping it", "user", userID, "err", err)
 			}
+		}()
+	}
+	wg.Wait()
+
+	w.ingester.userStatesMtx.Lock()
+	w.ingester.userStates = userStates
+	w.ingester.userStatesMtx.Unlock()
+
+	return nil
+}
+
+// listTenants returns the set of tenant IDs with a WAL directory, i.e. the
+// subdirectories of cfg.dir, excluding the legacy flat-layout names.
+func (w *wrapper) listTenants() ([]string, error) {
+	entries, err := ioutil.ReadDir(w.cfg.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
 		}
+		if entry.Name() == "samples" || entry.Name() == "checkpoints" {
+			continue
+		}
+		tenants = append(tenants, entry.Name())
+	}
+	return tenants, nil
+}
 
-		return nil
+func (w *wrapper) recoverTenant(ctx context.Context, userID string, userStates *userStates) error {
+	if err := w.recoverRecordsFrom(path.Join(w.cfg.dir, userID, "checkpoints"), &Series{}, func(msg proto.Message) error {
+		return recoverCheckpointSeries(ctx, userStates, msg.(*Series))
+	}); err != nil {
+		return err
+	}
+
+	return w.recoverRecordsFrom(path.Join(w.cfg.dir, userID, "samples"), &Record{}, func(msg proto.Message) error {
+		return recoverSamplesRecord(ctx, userStates, msg.(*Record))
+	})
+}
+
+// recoverLegacy replays the old, pre-partitioning flat WAL layout
+// (wal/samples, wal/checkpoints, shared by every tenant) into a single
+// userStates. Only called by migrateLegacy.
+func (w *wrapper) recoverLegacy(ctx context.Context) error {
+	userStates := newUserStates(w.ingester.limits, w.ingester.cfg)
+
+	if err := w.recoverRecordsFrom(path.Join(w.cfg.dir, "checkpoints"), &Series{}, func(msg proto.Message) error {
+		return recoverCheckpointSeries(ctx, userStates, msg.(*Series))
+	}); err != nil {
+		return err
+	}
+
+	if err := w.recoverRecordsFrom(path.Join(w.cfg.dir, "samples"), &Record{}, func(msg proto.Message) error {
+		return recoverSamplesRecord(ctx, userStates, msg.(*Record))
 	}); err != nil {
 		return err
 	}
@@ -295,8 +725,70 @@ func (w *wrapper) recover(ctx context.Context) error {
 	return nil
 }
 
-func (w *wrapper) recoverRecords(name string, ty proto.Message, callback func(proto.Message) error) error {
-	segmentReader, err := wal.NewSegmentsReader(path.Join(w.cfg.dir, name))
+func recoverCheckpointSeries(ctx context.Context, userStates *userStates, walSeries *Series) error {
+	descs, err := fromWireChunks(walSeries.Chunks)
+	if err != nil {
+		return err
+	}
+
+	userCtx := user.InjectOrgID(ctx, walSeries.UserId)
+	state, err := userStates.getOrCreate(userCtx)
+	if err != nil {
+		return err
+	}
+
+	series, err := state.createSeriesWithFingerprint(model.Fingerprint(walSeries.Fingerprint), walSeries.Labels, &Record{})
+	if err != nil {
+		return err
+	}
+
+	return series.setChunks(descs)
+}
+
+func recoverSamplesRecord(ctx context.Context, userStates *userStates, record *Record) error {
+	userCtx := user.InjectOrgID(ctx, record.UserId)
+
+	state, err := userStates.getOrCreate(userCtx)
+	if err != nil {
+		return err
+	}
+
+	for _, labels := range record.Labels {
+		_, ok := state.fpToSeries.get(model.Fingerprint(labels.Fingerprint))
+		if ok {
+			continue
+		}
+
+		_, err = state.createSeriesWithFingerprint(model.Fingerprint(labels.Fingerprint), labels.Labels, &Record{})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, sample := range record.Samples {
+		series, ok := state.fpToSeries.get(model.Fingerprint(sample.Fingerprint))
+		if !ok {
+			return nil
+		}
+
+		err := series.add(model.SamplePair{
+			Timestamp: model.Time(sample.Timestamp),
+			Value:     model.SampleValue(sample.Value),
+		})
+		if err != nil {
+			level.Info(util.Logger).Log("msg", "error appending sample", "err", err)
+		}
+	}
+
+	return nil
+}
+
+func (w *wrapper) recoverRecordsFrom(dir string, ty proto.Message, callback func(proto.Message) error) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	segmentReader, err := wal.NewSegmentsReader(dir)
 	if err != nil {
 		return err
 	}
@@ -305,7 +797,11 @@ func (w *wrapper) recoverRecords(name string, ty proto.Message, callback func(pr
 	reader := wal.NewReader(segmentReader)
 	for reader.Next() {
 		ty.Reset()
-		if err := proto.Unmarshal(reader.Record(), ty); err != nil {
+		rec, err := decode(reader.Record())
+		if err != nil {
+			return err
+		}
+		if err := proto.Unmarshal(rec, ty); err != nil {
 			return err
 		}
 
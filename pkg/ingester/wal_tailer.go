@@ -0,0 +1,252 @@
+package ingester
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/tsdb/wal"
+
+	"github.com/cortexproject/cortex/pkg/util"
+)
+
+// tailPollInterval is how often a subscriber checks its current segment
+// for newly appended bytes. We don't vendor fsnotify today, so this polls;
+// a future change can switch to fsnotify without touching Subscribe.
+const tailPollInterval = 250 * time.Millisecond
+
+// walCursor identifies how far a WALTailer subscriber has read into the
+// samples WAL.
+type walCursor struct {
+	Segment int   `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// WALTailer streams samples WAL records to registered subscribers as
+// they're appended. Each subscriber gets its own durable cursor file under
+// dir/tailers, so it resumes where it left off after a restart.
+// wrapper.truncateSamples won't remove a segment until every subscriber's
+// cursor has passed it.
+type WALTailer struct {
+	dir string
+
+	mtx         sync.Mutex
+	subscribers map[string]*walSubscriber
+	quit        chan struct{}
+	wait        sync.WaitGroup
+}
+
+type walSubscriber struct {
+	name       string
+	handler    func(*Record) error
+	cursorPath string
+
+	mtx    sync.Mutex
+	cursor walCursor
+}
+
+func newWALTailer(samplesDir string) *WALTailer {
+	return &WALTailer{
+		dir:         samplesDir,
+		subscribers: map[string]*walSubscriber{},
+		quit:        make(chan struct{}),
+	}
+}
+
+// Subscribe registers name to receive samples records from startSegment
+// onwards, or from its persisted cursor if one already exists from a
+// previous run. Only one subscription per name may be active at a time.
+func (t *WALTailer) Subscribe(name string, startSegment int, handler func(*Record) error) (walCursor, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if _, ok := t.subscribers[name]; ok {
+		return walCursor{}, fmt.Errorf("wal tailer: subscriber %q already registered", name)
+	}
+
+	cursorPath := filepath.Join(t.dir, "tailers", name+".cursor")
+	cursor, err := loadWALCursor(cursorPath, startSegment)
+	if err != nil {
+		return walCursor{}, err
+	}
+
+	s := &walSubscriber{
+		name:       name,
+		handler:    handler,
+		cursorPath: cursorPath,
+		cursor:     cursor,
+	}
+	t.subscribers[name] = s
+
+	t.wait.Add(1)
+	go t.run(s)
+
+	return cursor, nil
+}
+
+// minSegment returns the lowest segment any subscriber still needs to
+// read, and false if there are no subscribers to hold truncation back for.
+func (t *WALTailer) minSegment() (int, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	min := -1
+	for _, s := range t.subscribers {
+		s.mtx.Lock()
+		seg := s.cursor.Segment
+		s.mtx.Unlock()
+
+		if min == -1 || seg < min {
+			min = seg
+		}
+	}
+	return min, min != -1
+}
+
+// Stop halts all subscriber goroutines.
+func (t *WALTailer) Stop() {
+	close(t.quit)
+	t.wait.Wait()
+}
+
+func (t *WALTailer) run(s *walSubscriber) {
+	defer t.wait.Done()
+
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.quit:
+			return
+		case <-ticker.C:
+			if err := t.drain(s); err != nil {
+				level.Error(util.Logger).Log("msg", "wal tailer: error reading segment", "subscriber", s.name, "err", err)
+			}
+		}
+	}
+}
+
+// drain reads every record appended to s's current segment since its last
+// cursor, handing each to s.handler, then rolls onto the next segment once
+// the current one is exhausted and a newer one already exists.
+func (t *WALTailer) drain(s *walSubscriber) error {
+	for {
+		s.mtx.Lock()
+		cur := s.cursor
+		s.mtx.Unlock()
+
+		segmentPath := wal.SegmentName(t.dir, cur.Segment)
+		if _, err := os.Stat(segmentPath); os.IsNotExist(err) {
+			// Segment has been truncated away, or doesn't exist yet.
+			return nil
+		}
+
+		advanced, nextOffset, err := t.drainSegment(s, cur)
+		if err != nil {
+			return err
+		}
+
+		s.mtx.Lock()
+		s.cursor = walCursor{Segment: cur.Segment, Offset: nextOffset}
+		s.mtx.Unlock()
+		if err := s.persistCursor(); err != nil {
+			return err
+		}
+
+		if !advanced {
+			return nil
+		}
+
+		_, last, err := wal.Segments(t.dir)
+		if err != nil {
+			return err
+		}
+		if cur.Segment >= last {
+			return nil
+		}
+
+		s.mtx.Lock()
+		s.cursor = walCursor{Segment: cur.Segment + 1, Offset: 0}
+		s.mtx.Unlock()
+		if err := s.persistCursor(); err != nil {
+			return err
+		}
+	}
+}
+
+// drainSegment reads cur.Segment from the start, skipping over records
+// already delivered (those at or before cur.Offset) so a restart doesn't
+// redeliver them, then hands any new records to s.handler.
+func (t *WALTailer) drainSegment(s *walSubscriber, cur walCursor) (advancedToEOF bool, offset int64, err error) {
+	segment, err := wal.OpenReadSegment(wal.SegmentName(t.dir, cur.Segment))
+	if err != nil {
+		return false, cur.Offset, err
+	}
+	defer segment.Close()
+
+	reader := wal.NewLiveReader(util.Logger, wal.NewLiveReaderMetrics(nil), segment)
+	for reader.Next() {
+		if reader.Offset() <= cur.Offset {
+			continue
+		}
+
+		rec, err := decode(reader.Record())
+		if err != nil {
+			return false, reader.Offset(), err
+		}
+
+		record := &Record{}
+		if err := proto.Unmarshal(rec, record); err != nil {
+			return false, reader.Offset(), err
+		}
+		if err := s.handler(record); err != nil {
+			return false, reader.Offset(), err
+		}
+	}
+
+	if err := reader.Err(); err != nil && err != io.EOF {
+		return false, reader.Offset(), err
+	}
+
+	return true, reader.Offset(), nil
+}
+
+func loadWALCursor(path string, startSegment int) (walCursor, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return walCursor{Segment: startSegment}, nil
+	}
+	if err != nil {
+		return walCursor{}, err
+	}
+
+	var cursor walCursor
+	if err := json.Unmarshal(buf, &cursor); err != nil {
+		return walCursor{}, err
+	}
+	return cursor, nil
+}
+
+func (s *walSubscriber) persistCursor() error {
+	s.mtx.Lock()
+	cursor := s.cursor
+	s.mtx.Unlock()
+
+	buf, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.cursorPath), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.cursorPath, buf, 0666)
+}
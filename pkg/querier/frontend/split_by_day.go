@@ -2,19 +2,62 @@ package frontend
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/weaveworks/cortex/pkg/util"
 )
 
-const millisecondPerDay = int64(24 * time.Hour / time.Millisecond)
+var (
+	splitQueriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cortex_frontend_split_queries_total",
+		Help: "Total number of split queries a single request was split into.",
+	})
+	queryRangeParallelism = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cortex_frontend_query_range_parallelism",
+		Help: "Number of split sub-queries currently in flight.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(splitQueriesTotal, queryRangeParallelism)
+}
+
+// SplitByIntervalConfig configures the splitByInterval middleware.
+type SplitByIntervalConfig struct {
+	interval            time.Duration
+	maxQueryParallelism int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *SplitByIntervalConfig) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.interval, "querier.split-queries-by-interval", 24*time.Hour, "Split range queries into this interval and execute in parallel, 0 disables it.")
+	f.IntVar(&cfg.maxQueryParallelism, "querier.max-query-parallelism", 14, "Maximum number of split queries that will be scheduled in parallel by the frontend.")
+}
+
+type splitByInterval struct {
+	downstream          queryRangeMiddleware
+	interval            time.Duration
+	maxQueryParallelism int
+}
 
-type splitByDay struct {
-	downstream queryRangeMiddleware
+func newSplitByInterval(downstream queryRangeMiddleware, cfg SplitByIntervalConfig) queryRangeMiddleware {
+	parallelism := cfg.maxQueryParallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+
+	return &splitByInterval{
+		downstream:          downstream,
+		interval:            cfg.interval,
+		maxQueryParallelism: parallelism,
+	}
 }
 
 type response struct {
@@ -23,46 +66,74 @@ type response struct {
 	err  error
 }
 
-func (s splitByDay) Do(ctx context.Context, r queryRangeRequest) (*apiResponse, error) {
-	// First we're going to build new requests, one for each day, taking care
-	// to line up the boundaries with step.
-	reqs := splitQuery(r)
+func (s *splitByInterval) Do(ctx context.Context, r queryRangeRequest) (*apiResponse, error) {
+	// First we're going to build new requests, one for each split interval,
+	// taking care to line up the boundaries with step.
+	reqs := splitQuery(r, s.interval)
+	splitQueriesTotal.Add(float64(len(reqs)))
 
-	// Next, do the requests in parallel.
-	// If one of the requests fail, we want to be a  ble to cancel the rest of them.
+	// Next, do the requests in parallel, with a worker pool scoped to this
+	// call and bounded by maxQueryParallelism, so a huge range query doesn't
+	// spawn hundreds of goroutines against the store. If one of the
+	// requests fail, we want to be able to cancel the rest of them.
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	resps := make(chan response)
-	for _, req := range reqs {
-		go func(req queryRangeRequest) {
-			level.Debug(util.Logger).Log("msg", "Doing request", "request", fmt.Sprintf("%+v", req))
-			resp, err := s.downstream.Do(ctx, req)
-			level.Debug(util.Logger).Log("msg", "Got response", "response", fmt.Sprintf("%+v", resp), "err", err)
-			resps <- response{
-				req:  req,
-				resp: resp,
-				err:  err,
-			}
-		}(req)
+
+	workers := s.maxQueryParallelism
+	if workers > len(reqs) {
+		workers = len(reqs)
 	}
 
-	// Gather up the responses and errors.
-	var responses []response
-	var firstErr error
-	for range reqs {
-		select {
-		case resp := <-resps:
-			if resp.err != nil {
-				if firstErr == nil {
-					firstErr = resp.err
-					cancel()
+	jobs := make(chan queryRangeRequest, len(reqs))
+	for _, req := range reqs {
+		jobs <- req
+	}
+	close(jobs)
+
+	resps := make(chan response, len(reqs))
+	var producers sync.WaitGroup
+	producers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer producers.Done()
+
+			for req := range jobs {
+				queryRangeParallelism.Inc()
+				level.Debug(util.Logger).Log("msg", "Doing request", "request", fmt.Sprintf("%+v", req))
+				resp, err := s.downstream.Do(ctx, req)
+				level.Debug(util.Logger).Log("msg", "Got response", "response", fmt.Sprintf("%+v", resp), "err", err)
+				queryRangeParallelism.Dec()
+				resps <- response{
+					req:  req,
+					resp: resp,
+					err:  err,
 				}
-				continue
 			}
-
-			responses = append(responses, resp)
+		}()
+	}
+	go func() {
+		producers.Wait()
+		close(resps)
+	}()
+
+	// No querier.response-consumers pool here: the merge below sorts
+	// responses by start time before combining them, so there's nothing a
+	// concurrent drainer could coalesce ahead of that sort.
+	var (
+		responses []response
+		firstErr  error
+	)
+	for resp := range resps {
+		if resp.err != nil {
+			if firstErr == nil {
+				firstErr = resp.err
+				cancel()
+			}
+			continue
 		}
+		responses = append(responses, resp)
 	}
+
 	level.Debug(util.Logger).Log("msg", "Got responses", "responses", fmt.Sprintf("%+v", responses), "err", firstErr)
 	if firstErr != nil {
 		return nil, firstErr
@@ -85,10 +156,15 @@ func (s splitByDay) Do(ctx context.Context, r queryRangeRequest) (*apiResponse,
 	}
 }
 
-func splitQuery(r queryRangeRequest) []queryRangeRequest {
+func splitQuery(r queryRangeRequest, interval time.Duration) []queryRangeRequest {
+	if interval <= 0 {
+		return []queryRangeRequest{r}
+	}
+
+	intervalMillis := int64(interval / time.Millisecond)
 	reqs := []queryRangeRequest{}
-	for start := r.start; start < r.end; start = nextDayBoundary(start, r.step) + r.step {
-		end := nextDayBoundary(start, r.step)
+	for start := r.start; start < r.end; start = nextIntervalBoundary(start, r.step, intervalMillis) + r.step {
+		end := nextIntervalBoundary(start, r.step, intervalMillis)
 		if end+r.step >= r.end {
 			end = r.end
 		}
@@ -104,11 +180,11 @@ func splitQuery(r queryRangeRequest) []queryRangeRequest {
 	return reqs
 }
 
-// Round up to the step before the next day boundary.
-func nextDayBoundary(t, step int64) int64 {
-	offsetToDayBoundary := step - (t % millisecondPerDay % step)
-	t = ((t / millisecondPerDay) + 1) * millisecondPerDay
-	return t - offsetToDayBoundary
+// Round up to the step before the next interval boundary.
+func nextIntervalBoundary(t, step, interval int64) int64 {
+	offsetToBoundary := step - (t % interval % step)
+	t = ((t / interval) + 1) * interval
+	return t - offsetToBoundary
 }
 
 type byFirstTime []response